@@ -0,0 +1,21 @@
+package main
+
+import "log"
+
+// logDebugf logs a debug-level, structured log line. Debug lines are gated behind --verbose so
+// that a quiet deployment isn't flooded with per-request noise.
+func logDebugf(format string, args ...interface{}) {
+	if *verbose {
+		log.Printf("level=debug "+format, args...)
+	}
+}
+
+// logInfof logs an info-level, structured log line.
+func logInfof(format string, args ...interface{}) {
+	log.Printf("level=info "+format, args...)
+}
+
+// logErrorf logs an error-level, structured log line.
+func logErrorf(format string, args ...interface{}) {
+	log.Printf("level=error "+format, args...)
+}
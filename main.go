@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/iterator"
@@ -27,6 +32,9 @@ var (
 	credentials      = kingpin.Flag("credentials", "The path to the keyfile. If not present, client will use your default application credentials.").Short('c').Envar("GCSPROXY_CREDENTIALS").String()
 	readinessBuckets = kingpin.Flag("readiness-buckets", "Comma-separated list of bucket names to ping for readiness checks").Short('r').Envar("GCSPROXY_READINESS_BUCKETS").Default("gcp-public-data-landsat,gcp-public-data-nexrad-l2,gcp-public-data-sentinel-2").String()
 	signedUrlGet     = kingpin.Flag("get-signed-url", "Returns pre-signed url on get requests instead of actual data").Envar("GCSPROXY_GET_SIGNED_URL").Default("false").Bool()
+	signedUrlMethods = kingpin.Flag("signed-url-methods", "Comma-separated list of HTTP methods (GET, PUT, POST, DELETE) for which the proxy redirects to a signed GCS URL instead of proxying the request itself").Envar("GCSPROXY_SIGNED_URL_METHODS").Default("").String()
+	gcsEndpoint      = kingpin.Flag("gcs-endpoint", "Alternate GCS API endpoint to use instead of the production API, e.g. to point at a local fake GCS server in tests").Envar("GCSPROXY_GCS_ENDPOINT").String()
+	uploadChunkSize  = kingpin.Flag("upload-chunk-size", "Chunk size in bytes to use when streaming uploads to GCS; 0 uses the client library default").Envar("GCSPROXY_UPLOAD_CHUNK_SIZE").Default("0").Int()
 )
 
 var (
@@ -48,9 +56,9 @@ var (
 )
 
 type dirItem struct {
-	RelativePath string
-	ModifiedDate string
-	SizeBytes    string
+	RelativePath string `json:"name"`
+	ModifiedDate string `json:"modified"`
+	SizeBytes    string `json:"size"`
 }
 
 type dirTplArgs struct {
@@ -58,13 +66,62 @@ type dirTplArgs struct {
 	Items  []dirItem
 }
 
+// dirListing is the JSON representation of a directory listing, returned instead of the HTML
+// template when the client negotiates for it.
+type dirListing struct {
+	Prefix        string    `json:"prefix"`
+	Items         []dirItem `json:"items"`
+	NextPageToken string    `json:"nextPageToken,omitempty"`
+}
+
+const dirListingPageSize = 1000
+
+// wantsJSONListing reports whether r asked for a JSON directory listing, either via ?format=json
+// or an Accept header that prefers application/json over text/html.
+func wantsJSONListing(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// writeDirListingJSON writes a directory listing as JSON.
+func writeDirListingJSON(w http.ResponseWriter, listing dirListing) {
+	writeJSONResponse(w, listing)
+}
+
+// statusForErr maps a GCS/storage error to the HTTP status it should be reported as.
+func statusForErr(err error) int {
+	if err == storage.ErrObjectNotExist {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// withGeneration pins obj to the generation requested via ?generation=N, or returns obj unchanged
+// if the request doesn't specify one.
+func withGeneration(obj *storage.ObjectHandle, r *http.Request) (*storage.ObjectHandle, error) {
+	gen := r.URL.Query().Get("generation")
+	if gen == "" {
+		return obj, nil
+	}
+	n, err := strconv.ParseInt(gen, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generation: %v", err)
+	}
+	return obj.Generation(n), nil
+}
+
+// writeJSONResponse writes v to w as a JSON response body.
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
 func handleError(w http.ResponseWriter, err error) {
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), statusForErr(err))
 		return
 	}
 }
@@ -104,6 +161,9 @@ func (w *wrapResponseWriter) WriteHeader(status int) {
 func wrapper(fn func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		proc := time.Now()
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+
 		writer := &wrapResponseWriter{
 			ResponseWriter: w,
 			status:         http.StatusOK,
@@ -113,26 +173,51 @@ func wrapper(fn func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 		if ip, found := header(r, "X-Forwarded-For"); found {
 			addr = ip
 		}
-		if *verbose {
-			log.Printf("[%s] %.3f %d %s %s",
-				addr,
-				time.Now().Sub(proc).Seconds(),
-				writer.status,
-				r.Method,
-				r.URL,
-			)
+		requestsTotal.WithLabelValues(r.Method, strconv.Itoa(writer.status)).Inc()
+		logDebugf("[%s] %.3f %d %s %s",
+			addr,
+			time.Now().Sub(proc).Seconds(),
+			writer.status,
+			r.Method,
+			r.URL,
+		)
+	}
+}
+
+// isSignedURLMethod reports whether method should be handled by redirecting to a signed GCS URL
+// instead of being proxied directly. The legacy --get-signed-url flag covers both GET and HEAD,
+// matching its old behavior of signing whichever of the two getFile was serving, and is otherwise
+// equivalent to listing GET and HEAD in --signed-url-methods.
+func isSignedURLMethod(method string) bool {
+	if (method == http.MethodGet || method == http.MethodHead) && *signedUrlGet {
+		return true
+	}
+	for _, m := range strings.Split(*signedUrlMethods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), method) {
+			return true
 		}
 	}
+	return false
 }
 
-// generateV4GetObjectSignedURL generates object signed URL with GET method.
-func generateV4GetObjectSignedURL(bucket, object string) (string, error) {
+// generateV4SignedURL generates a V4 signed URL for bucket/object/method. Content-Type and
+// Content-Length are carried over from r's headers when present and signed along with the URL, so
+// that the client's follow-up request to GCS matches the signature.
+func generateV4SignedURL(bucket, object, method string, r *http.Request) (string, error) {
+	var headers []string
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		headers = append(headers, "Content-Type: "+ct)
+	}
+	if cl := r.Header.Get("Content-Length"); cl != "" {
+		headers = append(headers, "Content-Length: "+cl)
+	}
 	opts := &storage.SignedURLOptions{
 		Scheme:         storage.SigningSchemeV4,
-		Method:         "GET",
+		Method:         method,
 		GoogleAccessID: jwtConfig.Email,
 		PrivateKey:     jwtConfig.PrivateKey,
 		Expires:        time.Now().Add(1 * time.Hour),
+		Headers:        headers,
 	}
 	u, err := storage.SignedURL(bucket, object, opts)
 	if err != nil {
@@ -142,37 +227,145 @@ func generateV4GetObjectSignedURL(bucket, object string) (string, error) {
 	return u, nil
 }
 
+// parseRange parses a single-range HTTP Range header (RFC 7233) against an object of the given
+// size, returning the byte offset and length it selects. Multi-range requests aren't supported.
+func parseRange(rangeHeader string, size int64) (offset, length int64, ok bool) {
+	spec := strings.TrimPrefix(rangeHeader, "bytes=")
+	if spec == rangeHeader || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, end := parts[0], parts[1]
+
+	if start == "" {
+		suffix, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, true
+	}
+
+	first, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || first < 0 || first >= size {
+		return 0, 0, false
+	}
+	if end == "" {
+		return first, size - first, true
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	if last >= size {
+		last = size - 1
+	}
+	return first, last - first + 1, true
+}
+
 func getFile(w http.ResponseWriter, r *http.Request, bucket, object string) {
-	obj := client.Bucket(bucket).Object(object)
-	attr, err := obj.Attrs(ctx)
+	obj, err := withGeneration(client.Bucket(bucket).Object(object), r)
 	if err != nil {
-		handleError(w, err)
+		observeBucketRequest(bucket, r.Method, http.StatusBadRequest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	objr, err := obj.NewReader(ctx)
-	defer objr.Close()
 
+	var attr *storage.ObjectAttrs
+	err = observeGCSCall("attrs", func() error {
+		var attrErr error
+		attr, attrErr = obj.Attrs(ctx)
+		return attrErr
+	})
 	if err != nil {
+		observeBucketRequest(bucket, r.Method, statusForErr(err), err)
 		handleError(w, err)
 		return
 	}
 
-	if *signedUrlGet {
-		u, err := generateV4GetObjectSignedURL(bucket, object)
-		if err != nil {
-			handleError(w, err)
+	etag := fmt.Sprintf("%q", attr.Etag)
+	if match, ok := header(r, "If-None-Match"); ok && (match == "*" || match == etag) {
+		observeBucketRequest(bucket, r.Method, http.StatusNotModified, nil)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if since, ok := header(r, "If-Modified-Since"); ok {
+		if t, parseErr := http.ParseTime(since); parseErr == nil && !attr.Updated.Truncate(time.Second).After(t) {
+			observeBucketRequest(bucket, r.Method, http.StatusNotModified, nil)
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	}
+	if match, ok := header(r, "If-Match"); ok && match != "*" && match != etag {
+		observeBucketRequest(bucket, r.Method, http.StatusPreconditionFailed, nil)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if gen, ok := header(r, "If-Generation-Match"); ok {
+		n, parseErr := strconv.ParseInt(gen, 10, 64)
+		if parseErr != nil || n != attr.Generation {
+			observeBucketRequest(bucket, r.Method, http.StatusPreconditionFailed, nil)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		obj = obj.If(storage.Conditions{GenerationMatch: attr.Generation})
+	}
+
+	status := http.StatusOK
+	var rangeOffset, rangeLength int64
+	partial := false
+	if rangeHeader, ok := header(r, "Range"); ok {
+		offset, length, valid := parseRange(rangeHeader, attr.Size)
+		if !valid {
+			observeBucketRequest(bucket, r.Method, http.StatusRequestedRangeNotSatisfiable, nil)
+			setStrHeader(w, "Content-Range", fmt.Sprintf("bytes */%d", attr.Size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		rangeOffset, rangeLength = offset, length
+		status = http.StatusPartialContent
+		partial = true
+	}
+
+	var objr *storage.Reader
+	err = observeGCSCall("reader", func() error {
+		var readerErr error
+		if partial {
+			objr, readerErr = obj.NewRangeReader(ctx, rangeOffset, rangeLength)
+		} else {
+			objr, readerErr = obj.NewReader(ctx)
+		}
+		return readerErr
+	})
+	if err != nil {
+		observeBucketRequest(bucket, r.Method, statusForErr(err), err)
+		handleError(w, err)
+		return
+	}
+	defer objr.Close()
+
+	setStrHeader(w, "Content-Type", attr.ContentType)
+	setStrHeader(w, "Content-Language", attr.ContentLanguage)
+	setStrHeader(w, "Cache-Control", attr.CacheControl)
+	setStrHeader(w, "Content-Encoding", attr.ContentEncoding)
+	setStrHeader(w, "Content-Disposition", attr.ContentDisposition)
+	setStrHeader(w, "ETag", etag)
+	setStrHeader(w, "Accept-Ranges", "bytes")
+	if partial {
+		setStrHeader(w, "Content-Range", fmt.Sprintf("bytes %d-%d/%d", rangeOffset, rangeOffset+rangeLength-1, attr.Size))
+		setIntHeader(w, "Content-Length", rangeLength)
+		w.WriteHeader(http.StatusPartialContent)
 	} else {
-		setStrHeader(w, "Content-Type", attr.ContentType)
-		setStrHeader(w, "Content-Language", attr.ContentLanguage)
-		setStrHeader(w, "Cache-Control", attr.CacheControl)
-		setStrHeader(w, "Content-Encoding", attr.ContentEncoding)
-		setStrHeader(w, "Content-Disposition", attr.ContentDisposition)
 		setIntHeader(w, "Content-Length", attr.Size)
-		io.Copy(w, objr)
 	}
+	n, copyErr := io.Copy(w, objr)
+	bytesOutTotal.Add(float64(n))
+	observeBucketRequest(bucket, r.Method, status, copyErr)
 }
 
 func getDir(w http.ResponseWriter, r *http.Request, bucket, prefix string) {
@@ -182,57 +375,60 @@ func getDir(w http.ResponseWriter, r *http.Request, bucket, prefix string) {
 		http.Redirect(w, r, r.RequestURI+"/", http.StatusTemporaryRedirect)
 	}
 
-	query := &storage.Query{Prefix: prefix}
+	query := &storage.Query{Prefix: prefix, Delimiter: "/"}
 	var items []dirItem
-	lastName := ""
 	it := bkt.Objects(ctx, query)
+	it.PageInfo().MaxSize = dirListingPageSize
+	it.PageInfo().Token = r.URL.Query().Get("pageToken")
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
-		}
-
-		name := strings.TrimPrefix(attrs.Name, prefix)
-		// Skips directory itself
-		if len(name) == 0 {
-			continue
-		}
-
-		//Get only items in this dir, not in sub dir
-		nameParts := strings.Split(name, "/")
-		name = nameParts[0]
-		if name == lastName {
-			continue
-		} else {
-			lastName = name
+			observeBucketRequest(bucket, r.Method, statusForErr(err), err)
+			handleError(w, err)
+			return
 		}
 
 		var item dirItem
-		item.RelativePath = name
-		item.ModifiedDate = attrs.Created.Format("02-Jan-2006 15:04 UTC")
-		if len(nameParts) > 1 {
+		if attrs.Prefix != "" {
+			// Sub-directory, surfaced by the Delimiter instead of a nested object.
+			item.RelativePath = strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, prefix), "/")
 			item.SizeBytes = "-"
 		} else {
+			name := strings.TrimPrefix(attrs.Name, prefix)
+			if len(name) == 0 {
+				// Skips directory itself
+				continue
+			}
+			item.RelativePath = name
+			item.ModifiedDate = attrs.Created.Format("02-Jan-2006 15:04 UTC")
 			item.SizeBytes = strconv.FormatInt(attrs.Size, 10)
 		}
 
 		items = append(items, item)
+		if it.PageInfo().Remaining() == 0 {
+			break
+		}
 	}
+	nextPageToken := it.PageInfo().Token
 
 	if prefix == "" {
 		prefix = "/"
 	}
 
-	tmpl := template.Must(template.New("dir").Parse(dirTpl))
-	tmpl.Execute(w, dirTplArgs{
-		Prefix: prefix,
-		Items:  items,
-	})
+	if wantsJSONListing(r) {
+		writeDirListingJSON(w, dirListing{Prefix: prefix, Items: items, NextPageToken: nextPageToken})
+	} else {
+		tmpl := template.Must(template.New("dir").Parse(dirTpl))
+		tmpl.Execute(w, dirTplArgs{
+			Prefix: prefix,
+			Items:  items,
+		})
+	}
 
-	return
+	observeBucketRequest(bucket, r.Method, http.StatusOK, nil)
 }
 
 func isDirectory(bucket, prefix string) bool {
@@ -245,38 +441,327 @@ func isDirectory(bucket, prefix string) bool {
 	return item != nil
 }
 
+// populateWriterAttrs copies the standard content headers and any x-goog-meta-* headers from an
+// upload request (or multipart form part) onto a GCS object writer.
+func populateWriterAttrs(wc *storage.Writer, headers http.Header) {
+	if ct := headers.Get("Content-Type"); ct != "" {
+		wc.ContentType = ct
+	}
+	if ce := headers.Get("Content-Encoding"); ce != "" {
+		wc.ContentEncoding = ce
+	}
+	if cc := headers.Get("Cache-Control"); cc != "" {
+		wc.CacheControl = cc
+	}
+	if cd := headers.Get("Content-Disposition"); cd != "" {
+		wc.ContentDisposition = cd
+	}
+	if meta := metadataFromHeaders(headers); meta != nil {
+		wc.Metadata = meta
+	}
+}
+
+// metadataFromHeaders collects X-Goog-Meta-* headers into a custom metadata map, or returns nil if
+// none are present.
+func metadataFromHeaders(headers http.Header) map[string]string {
+	meta := map[string]string{}
+	for key, values := range headers {
+		if len(values) == 0 || !strings.HasPrefix(key, "X-Goog-Meta-") {
+			continue
+		}
+		meta[strings.TrimPrefix(key, "X-Goog-Meta-")] = values[0]
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// objectAttrsToUpdate builds the set of object attributes to change from a PATCH request's
+// headers, following the same X-Goog-Meta-* and content-header conventions as uploads.
+func objectAttrsToUpdate(headers http.Header) storage.ObjectAttrsToUpdate {
+	var update storage.ObjectAttrsToUpdate
+	if ct := headers.Get("Content-Type"); ct != "" {
+		update.ContentType = ct
+	}
+	if ce := headers.Get("Content-Encoding"); ce != "" {
+		update.ContentEncoding = ce
+	}
+	if cc := headers.Get("Cache-Control"); cc != "" {
+		update.CacheControl = cc
+	}
+	if cd := headers.Get("Content-Disposition"); cd != "" {
+		update.ContentDisposition = cd
+	}
+	if meta := metadataFromHeaders(headers); meta != nil {
+		update.Metadata = meta
+	}
+	return update
+}
+
+// objectMetadata is the JSON representation returned for PATCH requests.
+type objectMetadata struct {
+	Name               string            `json:"name"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Size               int64             `json:"size"`
+	Generation         int64             `json:"generation"`
+}
+
+func objectMetadataJSON(attrs *storage.ObjectAttrs) objectMetadata {
+	return objectMetadata{
+		Name:               attrs.Name,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		Metadata:           attrs.Metadata,
+		Size:               attrs.Size,
+		Generation:         attrs.Generation,
+	}
+}
+
+// aclRule is the JSON representation of a single storage.ACLRule entry.
+type aclRule struct {
+	Entity string `json:"entity"`
+	Role   string `json:"role"`
+}
+
+// handlePatch updates an object's metadata via obj.Update, driven by the same headers an upload
+// would use to set it.
+func handlePatch(w http.ResponseWriter, r *http.Request, bucket string, obj *storage.ObjectHandle) {
+	update := objectAttrsToUpdate(r.Header)
+
+	var attrs *storage.ObjectAttrs
+	err := observeGCSCall("update", func() error {
+		var updateErr error
+		attrs, updateErr = obj.Update(ctx, update)
+		return updateErr
+	})
+	if err != nil {
+		observeBucketRequest(bucket, r.Method, statusForErr(err), err)
+		handleError(w, err)
+		return
+	}
+	observeBucketRequest(bucket, r.Method, http.StatusOK, nil)
+	writeJSONResponse(w, objectMetadataJSON(attrs))
+}
+
+// aclEntity reports whether r carries an ?acl= query parameter, and if so its value (which is
+// empty when the caller asked for the full ACL list rather than a single entity).
+func aclEntity(r *http.Request) (string, bool) {
+	values, ok := r.URL.Query()["acl"]
+	if !ok {
+		return "", false
+	}
+	if len(values) == 0 {
+		return "", true
+	}
+	return values[0], true
+}
+
+// handleACL implements ACL management for a bucket or object via ?acl=<entity>, using acl (either
+// bkt.ACL() or obj.ACL()). An empty entity value means "the full ACL list" for GET, and is invalid
+// for PUT/DELETE.
+func handleACL(w http.ResponseWriter, r *http.Request, bucket string, acl *storage.ACLHandle, entity string) {
+	switch r.Method {
+	case http.MethodGet:
+		var rules []storage.ACLRule
+		err := observeGCSCall("acl-list", func() error {
+			var listErr error
+			rules, listErr = acl.List(ctx)
+			return listErr
+		})
+		if err != nil {
+			observeBucketRequest(bucket, r.Method, statusForErr(err), err)
+			handleError(w, err)
+			return
+		}
+		if entity == "" {
+			out := make([]aclRule, len(rules))
+			for i, rule := range rules {
+				out[i] = aclRule{Entity: string(rule.Entity), Role: string(rule.Role)}
+			}
+			observeBucketRequest(bucket, r.Method, http.StatusOK, nil)
+			writeJSONResponse(w, out)
+			return
+		}
+		for _, rule := range rules {
+			if string(rule.Entity) == entity {
+				observeBucketRequest(bucket, r.Method, http.StatusOK, nil)
+				writeJSONResponse(w, aclRule{Entity: string(rule.Entity), Role: string(rule.Role)})
+				return
+			}
+		}
+		observeBucketRequest(bucket, r.Method, http.StatusNotFound, nil)
+		http.Error(w, "acl entity not found", http.StatusNotFound)
+	case http.MethodPut:
+		if entity == "" {
+			http.Error(w, "acl entity required", http.StatusBadRequest)
+			return
+		}
+		role := r.Header.Get("X-Goog-Acl-Role")
+		if role == "" {
+			http.Error(w, "X-Goog-Acl-Role header required", http.StatusBadRequest)
+			return
+		}
+		err := observeGCSCall("acl-set", func() error {
+			return acl.Set(ctx, storage.ACLEntity(entity), storage.ACLRole(role))
+		})
+		if err != nil {
+			observeBucketRequest(bucket, r.Method, statusForErr(err), err)
+			handleError(w, err)
+			return
+		}
+		observeBucketRequest(bucket, r.Method, http.StatusOK, nil)
+	case http.MethodDelete:
+		if entity == "" {
+			http.Error(w, "acl entity required", http.StatusBadRequest)
+			return
+		}
+		err := observeGCSCall("acl-delete", func() error {
+			return acl.Delete(ctx, storage.ACLEntity(entity))
+		})
+		if err != nil {
+			observeBucketRequest(bucket, r.Method, statusForErr(err), err)
+			handleError(w, err)
+			return
+		}
+		observeBucketRequest(bucket, r.Method, http.StatusOK, nil)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeObject streams body into obj, honoring the content headers and x-goog-meta-* metadata on
+// headers, and records the bucket/upstream metrics for the upload.
+func writeObject(w http.ResponseWriter, bucket, method string, obj *storage.ObjectHandle, headers http.Header, body io.Reader) {
+	wc := obj.NewWriter(ctx)
+	if *uploadChunkSize > 0 {
+		wc.ChunkSize = *uploadChunkSize
+	}
+	populateWriterAttrs(wc, headers)
+
+	err := observeGCSCall("writer", func() error {
+		n, copyErr := io.Copy(wc, body)
+		bytesInTotal.Add(float64(n))
+		if copyErr != nil {
+			wc.Close()
+			return copyErr
+		}
+		return wc.Close()
+	})
+	if err != nil {
+		observeBucketRequest(bucket, method, statusForErr(err), err)
+		handleError(w, err)
+		return
+	}
+	observeBucketRequest(bucket, method, http.StatusOK, nil)
+}
+
+// bucketProxy handles requests for a bucket with no object component, currently limited to
+// bucket-level ACL management via GET/PUT/DELETE /{bucket}?acl=<entity>.
+func bucketProxy(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	bkt := client.Bucket(params["bucket"])
+
+	if entity, ok := aclEntity(r); ok {
+		handleACL(w, r, params["bucket"], bkt.ACL(), entity)
+		return
+	}
+
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
+
 func proxy(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	bkt := client.Bucket(params["bucket"])
-	obj := bkt.Object(params["object"])
+	obj, err := withGeneration(bkt.Object(params["object"]), r)
+	if err != nil {
+		observeBucketRequest(params["bucket"], r.Method, http.StatusBadRequest, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	isDirRequest := (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		isDirectory(params["bucket"], params["object"])
+
+	// A signed URL only ever points at a single object, so GET/HEAD requests for a directory
+	// listing must keep being served by getDir below instead of being redirected.
+	if isSignedURLMethod(r.Method) && !isDirRequest {
+		u, err := generateV4SignedURL(params["bucket"], params["object"], r.Method, r)
+		if err != nil {
+			observeBucketRequest(params["bucket"], r.Method, statusForErr(err), err)
+			handleError(w, err)
+			return
+		}
+		observeBucketRequest(params["bucket"], r.Method, http.StatusTemporaryRedirect, nil)
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		return
+	}
+
+	if entity, ok := aclEntity(r); ok {
+		handleACL(w, r, params["bucket"], obj.ACL(), entity)
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		handlePatch(w, r, params["bucket"], obj)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
-		if isDirectory(params["bucket"], params["object"]) {
+		if isDirRequest {
 			getDir(w, r, params["bucket"], params["object"])
 		} else {
 			getFile(w, r, params["bucket"], params["object"])
 		}
 
 	case http.MethodPost, http.MethodPut:
-		wc := obj.NewWriter(ctx)
-		fileData, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			handleError(w, err)
-			return
-		}
-		if _, err := wc.Write(fileData); err != nil {
-			handleError(w, err)
+		mediaType, mediaParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(r.Body, mediaParams["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					handleError(w, err)
+					return
+				}
+				if part.FileName() == "" {
+					continue
+				}
+				partObj := bkt.Object(path.Join(params["object"], part.FileName()))
+				writeObject(w, params["bucket"], r.Method, partObj, http.Header(part.Header), part)
+			}
 			return
 		}
-		if err := wc.Close(); err != nil {
-			handleError(w, err)
-			return
+
+		if gen, ok := header(r, "If-Generation-Match"); ok {
+			n, err := strconv.ParseInt(gen, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid If-Generation-Match", http.StatusBadRequest)
+				return
+			}
+			obj = obj.If(storage.Conditions{GenerationMatch: n})
 		}
+		writeObject(w, params["bucket"], r.Method, obj, r.Header, r.Body)
 	case http.MethodDelete:
-		if err := obj.Delete(ctx); err != nil {
+		err := observeGCSCall("delete", func() error {
+			return obj.Delete(ctx)
+		})
+		if err != nil {
+			observeBucketRequest(params["bucket"], r.Method, statusForErr(err), err)
 			handleError(w, err)
 			return
 		}
+		observeBucketRequest(params["bucket"], r.Method, http.StatusOK, nil)
 	default:
 		http.Error(w, "Method Not Allowed", http.StatusNotFound)
 		return
@@ -314,14 +799,12 @@ func readinessProbeHandler(w http.ResponseWriter, r *http.Request) {
 	for range bucketList {
 		br := <-ch
 		if br.err == nil {
-			if *verbose {
-				log.Printf("received metadata for bucket %s",
-					br.bucketName,
-				)
-			}
+			logDebugf("received metadata for bucket %s",
+				br.bucketName,
+			)
 			return
 		}
-		log.Printf("error receiving metadata for bucket %s: %s",
+		logErrorf("error receiving metadata for bucket %s: %s",
 			br.bucketName,
 			br.err,
 		)
@@ -329,20 +812,32 @@ func readinessProbeHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusServiceUnavailable)
 }
 
+// newStorageClient builds a GCS client. When endpoint is set it is pointed at that API endpoint
+// with authentication disabled instead of the production API, which lets tests inject an
+// in-process fake GCS server in place of real credentials and network access.
+func newStorageClient(ctx context.Context, credentials, endpoint string) (*storage.Client, error) {
+	if endpoint != "" {
+		return storage.NewClient(ctx, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+	}
+	if credentials != "" {
+		return storage.NewClient(ctx, option.WithCredentialsFile(credentials))
+	}
+	return storage.NewClient(ctx)
+}
+
 func initClient() {
 	var err error
-	if *credentials != "" {
-		client, err = storage.NewClient(ctx, option.WithCredentialsFile(*credentials))
-		log.Printf("Starting gcsproxy with credentials")
-	} else {
-		client, err = storage.NewClient(ctx)
-		log.Printf("Starting gcsproxy without credentials")
-	}
+	client, err = newStorageClient(ctx, *credentials, *gcsEndpoint)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
+	if *credentials != "" {
+		logInfof("Starting gcsproxy with credentials")
+	} else {
+		logInfof("Starting gcsproxy without credentials")
+	}
 
-	if *signedUrlGet {
+	if *signedUrlGet || *signedUrlMethods != "" {
 		jsonKey, err := ioutil.ReadFile(*credentials)
 		if err != nil {
 			log.Fatalf("ioutil.ReadFile: %v", err)
@@ -361,11 +856,13 @@ func main() {
 	initClient()
 
 	r := mux.NewRouter()
-	r.HandleFunc("/{bucket:[0-9a-zA-Z-_.]+}/{object:.*}", wrapper(proxy)).Methods("GET", "HEAD", "PUT", "POST", "DELETE")
 	r.HandleFunc("/healthz", wrapper(livenessProbeHandler)).Methods("GET")
 	r.HandleFunc("/readiness", wrapper(readinessProbeHandler)).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/{bucket:[0-9a-zA-Z-_.]+}", wrapper(bucketProxy)).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/{bucket:[0-9a-zA-Z-_.]+}/{object:.*}", wrapper(proxy)).Methods("GET", "HEAD", "PUT", "POST", "DELETE", "PATCH")
 
-	log.Printf("[service] listening on %s", *bind)
+	logInfof("[service] listening on %s", *bind)
 	if err := http.ListenAndServe(*bind, r); err != nil {
 		log.Fatal(err)
 	}
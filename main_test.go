@@ -1,10 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2/jwt"
 )
 
 func TestLivenessProbeHandler(t *testing.T) {
@@ -20,20 +32,23 @@ func TestLivenessProbeHandler(t *testing.T) {
 	}
 }
 
-// TestReadinessProbeHandler relies on Google's public buckets being available otherwise this test may return false
-// positives.
+// TestReadinessProbeHandler exercises the handler against an in-process fake GCS server, so it no
+// longer depends on real Google Cloud Storage buckets being reachable.
 func TestReadinessProbeHandler(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "good-bucket", Name: "marker", Contents: []byte("x")})
+	defer srv.Close()
+	client = srv.client(t)
 
 	var tests = []struct {
-		Name string
-		value string
+		Name     string
+		value    string
 		expected int
 	}{
-		{"good", "gcp-public-data-landsat,gcp-public-data-nexrad-l2,gcp-public-data-sentinel-2", http.StatusOK},
+		{"good", "good-bucket", http.StatusOK},
 		{"bad", "fake-bucket-1", http.StatusServiceUnavailable},
 		{"bad-bad", "fake-bucket-1,fake-bucket-2", http.StatusServiceUnavailable},
-		{"bad-good", "fake-bucket-1,gcp-public-data-landsat,gcp-public-data-nexrad-l2,gcp-public-data-sentinel-2", http.StatusOK},
-		{"good-bad", "gcp-public-data-landsat,gcp-public-data-nexrad-l2,gcp-public-data-sentinel-2,fake-bucket-1", http.StatusOK},
+		{"bad-good", "fake-bucket-1,good-bucket", http.StatusOK},
+		{"good-bad", "good-bucket,fake-bucket-1", http.StatusOK},
 	}
 
 	req, err := http.NewRequest("GET", "/readiness", nil)
@@ -50,10 +65,561 @@ func TestReadinessProbeHandler(t *testing.T) {
 			t.Errorf("handler returned incorrect status code for test '%s': got %v want %v", test.Name, status, test.expected)
 		}
 	}
+}
+
+func TestGetFile(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "dir/file.txt", Contents: []byte("hello world"), ContentType: "text/plain"})
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/dir/file.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	getFile(rr, req, "bkt", "dir/file.txt")
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("getFile returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if body := rr.Body.String(); body != "hello world" {
+		t.Errorf("getFile returned wrong body: got %q want %q", body, "hello world")
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("getFile returned wrong Content-Type: got %q want %q", ct, "text/plain")
+	}
+}
+
+func TestGetFileRange(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "file.txt", Contents: []byte("hello world"), ContentType: "text/plain"})
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/file.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=6-10")
+	rr := httptest.NewRecorder()
+	getFile(rr, req, "bkt", "file.txt")
+
+	if status := rr.Code; status != http.StatusPartialContent {
+		t.Fatalf("getFile returned wrong status code: got %v want %v", status, http.StatusPartialContent)
+	}
+	if body := rr.Body.String(); body != "world" {
+		t.Errorf("getFile returned wrong range body: got %q want %q", body, "world")
+	}
+	if cr := rr.Header().Get("Content-Range"); cr != "bytes 6-10/11" {
+		t.Errorf("getFile returned wrong Content-Range: got %q want %q", cr, "bytes 6-10/11")
+	}
+}
+
+func TestGetFileIfNoneMatch(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "file.txt", Contents: []byte("hello world"), ContentType: "text/plain"})
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/file.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", "*")
+	rr := httptest.NewRecorder()
+	getFile(rr, req, "bkt", "file.txt")
+
+	if status := rr.Code; status != http.StatusNotModified {
+		t.Errorf("getFile returned wrong status code: got %v want %v", status, http.StatusNotModified)
+	}
+}
+
+func TestGetFileNotFound(t *testing.T) {
+	srv := newFakeGCSServer()
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/missing.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	getFile(rr, req, "bkt", "missing.txt")
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("getFile returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestIsDirectory(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "dir/file.txt", Contents: []byte("x")})
+	defer srv.Close()
+	client = srv.client(t)
+
+	if !isDirectory("bkt", "dir") {
+		t.Errorf("isDirectory(%q) = false, want true", "dir")
+	}
+	if isDirectory("bkt", "dir/file.txt") {
+		t.Errorf("isDirectory(%q) = true, want false", "dir/file.txt")
+	}
+}
+
+func TestGetDir(t *testing.T) {
+	srv := newFakeGCSServer(
+		fakeObject{Bucket: "bkt", Name: "dir/a.txt", Contents: []byte("a")},
+		fakeObject{Bucket: "bkt", Name: "dir/b.txt", Contents: []byte("bb")},
+	)
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/dir/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	getDir(rr, req, "bkt", "dir/")
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("getDir returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "a.txt") || !strings.Contains(body, "b.txt") {
+		t.Errorf("getDir listing missing expected entries: %s", body)
+	}
+}
+
+func TestGetDirSubdirectories(t *testing.T) {
+	srv := newFakeGCSServer(
+		fakeObject{Bucket: "bkt", Name: "dir/a.txt", Contents: []byte("a")},
+		fakeObject{Bucket: "bkt", Name: "dir/sub/b.txt", Contents: []byte("bb")},
+	)
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/dir/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	getDir(rr, req, "bkt", "dir/")
+
+	body := rr.Body.String()
+	if !strings.Contains(body, "a.txt") || !strings.Contains(body, "sub") {
+		t.Errorf("getDir listing missing expected entries: %s", body)
+	}
+	if strings.Contains(body, "b.txt") {
+		t.Errorf("getDir listing should not descend into subdirectories: %s", body)
+	}
+}
+
+func TestGetDirPagination(t *testing.T) {
+	objects := make([]fakeObject, 0, dirListingPageSize+1)
+	for i := 0; i < dirListingPageSize+1; i++ {
+		objects = append(objects, fakeObject{Bucket: "bkt", Name: fmt.Sprintf("dir/%04d.txt", i), Contents: []byte("x")})
+	}
+	srv := newFakeGCSServer(objects...)
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/dir/?format=json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	getDir(rr, req, "bkt", "dir/")
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("getDir returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var firstPage dirListing
+	if err := json.Unmarshal(rr.Body.Bytes(), &firstPage); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(firstPage.Items) != dirListingPageSize {
+		t.Fatalf("first page len(Items) = %d, want %d", len(firstPage.Items), dirListingPageSize)
+	}
+	if firstPage.NextPageToken == "" {
+		t.Fatal("first page NextPageToken is empty, want a token for the remaining entry")
+	}
+
+	req, err = http.NewRequest("GET", "/bkt/dir/?format=json&pageToken="+firstPage.NextPageToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	getDir(rr, req, "bkt", "dir/")
+
+	var secondPage dirListing
+	if err := json.Unmarshal(rr.Body.Bytes(), &secondPage); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if len(secondPage.Items) != 1 {
+		t.Fatalf("second page len(Items) = %d, want %d", len(secondPage.Items), 1)
+	}
+	if secondPage.NextPageToken != "" {
+		t.Errorf("second page NextPageToken = %q, want empty", secondPage.NextPageToken)
+	}
+}
+
+func TestGetDirJSON(t *testing.T) {
+	srv := newFakeGCSServer(
+		fakeObject{Bucket: "bkt", Name: "dir/a.txt", Contents: []byte("a")},
+		fakeObject{Bucket: "bkt", Name: "dir/sub/b.txt", Contents: []byte("bb")},
+	)
+	defer srv.Close()
+	client = srv.client(t)
+
+	req, err := http.NewRequest("GET", "/bkt/dir/?format=json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	getDir(rr, req, "bkt", "dir/")
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("getDir returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("getDir returned wrong Content-Type: got %q want %q", ct, "application/json")
+	}
+
+	var listing dirListing
+	if err := json.Unmarshal(rr.Body.Bytes(), &listing); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if listing.Prefix != "dir/" {
+		t.Errorf("listing.Prefix = %q, want %q", listing.Prefix, "dir/")
+	}
+	names := map[string]bool{}
+	for _, item := range listing.Items {
+		names[item.RelativePath] = true
+	}
+	if !names["a.txt"] || !names["sub"] {
+		t.Errorf("listing.Items missing expected entries: %+v", listing.Items)
+	}
+}
+
+func proxyRequest(t *testing.T, method, bucket, object string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, "/"+bucket+"/"+object, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = mux.SetURLVars(req, map[string]string{"bucket": bucket, "object": object})
+	rr := httptest.NewRecorder()
+	proxy(rr, req)
+	return rr
+}
+
+func TestProxyPut(t *testing.T) {
+	srv := newFakeGCSServer()
+	defer srv.Close()
+	client = srv.client(t)
+
+	rr := proxyRequest(t, http.MethodPut, "bkt", "uploaded.txt", []byte("uploaded contents"), nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy PUT returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	obj, ok := srv.get("bkt", "uploaded.txt")
+	if !ok {
+		t.Fatal("proxy PUT did not create the object")
+	}
+	if string(obj.Contents) != "uploaded contents" {
+		t.Errorf("stored object contents = %q, want %q", obj.Contents, "uploaded contents")
+	}
+}
+
+func TestProxyPutMetadata(t *testing.T) {
+	srv := newFakeGCSServer()
+	defer srv.Close()
+	client = srv.client(t)
+
+	rr := proxyRequest(t, http.MethodPut, "bkt", "uploaded.txt", []byte("data"), map[string]string{
+		"Content-Type":   "application/x-custom",
+		"X-Goog-Meta-Id": "42",
+	})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy PUT returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	obj, ok := srv.get("bkt", "uploaded.txt")
+	if !ok {
+		t.Fatal("proxy PUT did not create the object")
+	}
+	if obj.ContentType != "application/x-custom" {
+		t.Errorf("stored object ContentType = %q, want %q", obj.ContentType, "application/x-custom")
+	}
+	if obj.Metadata["Id"] != "42" {
+		t.Errorf("stored object Metadata[Id] = %q, want %q", obj.Metadata["Id"], "42")
+	}
+}
+
+func TestProxyPutMultipart(t *testing.T) {
+	srv := newFakeGCSServer()
+	defer srv.Close()
+	client = srv.client(t)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte("multipart contents")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, "/bkt/dir", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req = mux.SetURLVars(req, map[string]string{"bucket": "bkt", "object": "dir"})
+	rr := httptest.NewRecorder()
+	proxy(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy multipart PUT returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	obj, ok := srv.get("bkt", "dir/upload.txt")
+	if !ok {
+		t.Fatal("proxy multipart PUT did not create dir/upload.txt")
+	}
+	if string(obj.Contents) != "multipart contents" {
+		t.Errorf("stored object contents = %q, want %q", obj.Contents, "multipart contents")
+	}
+}
+
+// TestProxyPutChunked covers --upload-chunk-size, which makes writeObject use the client
+// library's resumable upload protocol instead of the single-shot default exercised by TestProxyPut.
+func TestProxyPutChunked(t *testing.T) {
+	srv := newFakeGCSServer()
+	defer srv.Close()
+	client = srv.client(t)
+
+	old := *uploadChunkSize
+	*uploadChunkSize = 256 * 1024
+	defer func() { *uploadChunkSize = old }()
+
+	rr := proxyRequest(t, http.MethodPut, "bkt", "uploaded.txt", []byte("uploaded contents"), nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy PUT returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	obj, ok := srv.get("bkt", "uploaded.txt")
+	if !ok {
+		t.Fatal("proxy PUT did not create the object")
+	}
+	if string(obj.Contents) != "uploaded contents" {
+		t.Errorf("stored object contents = %q, want %q", obj.Contents, "uploaded contents")
+	}
+}
+
+func TestProxyDelete(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "to-delete.txt", Contents: []byte("x")})
+	defer srv.Close()
+	client = srv.client(t)
+
+	rr := proxyRequest(t, http.MethodDelete, "bkt", "to-delete.txt", nil, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy DELETE returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if _, ok := srv.get("bkt", "to-delete.txt"); ok {
+		t.Error("proxy DELETE did not remove the object")
+	}
+}
+
+// TestProxySignedURLRedirect verifies that a method listed in --signed-url-methods is redirected
+// to a signed GCS URL instead of being proxied.
+func TestProxyPatch(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "file.txt", Contents: []byte("x"), ContentType: "text/plain"})
+	defer srv.Close()
+	client = srv.client(t)
+
+	rr := proxyRequest(t, http.MethodPatch, "bkt", "file.txt", nil, map[string]string{
+		"Content-Type":   "application/x-custom",
+		"X-Goog-Meta-Id": "7",
+	})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy PATCH returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	obj, ok := srv.get("bkt", "file.txt")
+	if !ok {
+		t.Fatal("proxy PATCH lost the object")
+	}
+	if obj.ContentType != "application/x-custom" {
+		t.Errorf("stored object ContentType = %q, want %q", obj.ContentType, "application/x-custom")
+	}
+	if obj.Metadata["Id"] != "7" {
+		t.Errorf("stored object Metadata[Id] = %q, want %q", obj.Metadata["Id"], "7")
+	}
+}
+
+func aclRequest(t *testing.T, method, bucket, object string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, "/"+bucket+"/"+object+"?acl=allUsers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = mux.SetURLVars(req, map[string]string{"bucket": bucket, "object": object})
+	rr := httptest.NewRecorder()
+	proxy(rr, req)
+	return rr
+}
+
+func TestProxyACL(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "file.txt", Contents: []byte("x")})
+	defer srv.Close()
+	client = srv.client(t)
+
+	rr := aclRequest(t, http.MethodPut, "bkt", "file.txt", map[string]string{"X-Goog-Acl-Role": "READER"})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy ACL PUT returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	rr = aclRequest(t, http.MethodGet, "bkt", "file.txt", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy ACL GET returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var rule aclRule
+	if err := json.Unmarshal(rr.Body.Bytes(), &rule); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if rule.Entity != "allUsers" || rule.Role != "READER" {
+		t.Errorf("got acl rule %+v, want {allUsers READER}", rule)
+	}
+
+	rr = aclRequest(t, http.MethodDelete, "bkt", "file.txt", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy ACL DELETE returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	rr = aclRequest(t, http.MethodGet, "bkt", "file.txt", nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Fatalf("proxy ACL GET after delete returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func bucketACLRequest(t *testing.T, method, bucket string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, "/"+bucket+"?acl=allUsers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = mux.SetURLVars(req, map[string]string{"bucket": bucket})
+	rr := httptest.NewRecorder()
+	bucketProxy(rr, req)
+	return rr
+}
+
+func TestBucketProxyACL(t *testing.T) {
+	srv := newFakeGCSServer(fakeObject{Bucket: "bkt", Name: "file.txt", Contents: []byte("x")})
+	defer srv.Close()
+	client = srv.client(t)
+
+	rr := bucketACLRequest(t, http.MethodPut, "bkt", map[string]string{"X-Goog-Acl-Role": "READER"})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("bucketProxy ACL PUT returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	rr = bucketACLRequest(t, http.MethodGet, "bkt", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("bucketProxy ACL GET returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var rule aclRule
+	if err := json.Unmarshal(rr.Body.Bytes(), &rule); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if rule.Entity != "allUsers" || rule.Role != "READER" {
+		t.Errorf("got acl rule %+v, want {allUsers READER}", rule)
+	}
+
+	rr = bucketACLRequest(t, http.MethodDelete, "bkt", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("bucketProxy ACL DELETE returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	rr = bucketACLRequest(t, http.MethodGet, "bkt", nil)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Fatalf("bucketProxy ACL GET after delete returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestProxySignedURLRedirect(t *testing.T) {
+	srv := newFakeGCSServer()
+	defer srv.Close()
+	client = srv.client(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtConfig = &jwt.Config{
+		Email:      "test@example.com",
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+	defer func() { jwtConfig = nil }()
 
+	old := *signedUrlMethods
+	*signedUrlMethods = "PUT"
+	defer func() { *signedUrlMethods = old }()
+
+	rr := proxyRequest(t, http.MethodPut, "bkt", "uploaded.txt", []byte("data"), nil)
+	if status := rr.Code; status != http.StatusTemporaryRedirect {
+		t.Fatalf("proxy PUT returned wrong status code: got %v want %v", status, http.StatusTemporaryRedirect)
+	}
+	if loc := rr.Header().Get("Location"); !strings.Contains(loc, "uploaded.txt") {
+		t.Errorf("proxy PUT redirect Location missing object name: got %q", loc)
+	}
+}
+
+// TestProxySignedURLRedirectSkipsDirectories verifies that a GET for a directory prefix is still
+// served as a listing by getDir, rather than being redirected to a signed URL for an object that
+// doesn't exist.
+func TestProxySignedURLRedirectSkipsDirectories(t *testing.T) {
+	srv := newFakeGCSServer(
+		fakeObject{Bucket: "bkt", Name: "dir/a.txt", Contents: []byte("a")},
+		fakeObject{Bucket: "bkt", Name: "dir/b.txt", Contents: []byte("bb")},
+	)
+	defer srv.Close()
+	client = srv.client(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtConfig = &jwt.Config{
+		Email:      "test@example.com",
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+	defer func() { jwtConfig = nil }()
+
+	old := *signedUrlGet
+	*signedUrlGet = true
+	defer func() { *signedUrlGet = old }()
+
+	rr := proxyRequest(t, http.MethodGet, "bkt", "dir/", nil, nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("proxy GET on directory returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "a.txt") || !strings.Contains(body, "b.txt") {
+		t.Errorf("proxy GET on directory did not return a listing: %s", body)
+	}
 }
 
 func TestMain(m *testing.M) {
-	initClient()
 	os.Exit(m.Run())
 }
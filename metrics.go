@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcsproxy_requests_total",
+			Help: "Total number of HTTP requests handled, by method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcsproxy_requests_in_flight",
+		Help: "Number of HTTP requests currently being served.",
+	})
+
+	bucketRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcsproxy_bucket_requests_total",
+			Help: "Total number of requests against a bucket, by bucket, method and status code.",
+		},
+		[]string{"bucket", "method", "code"},
+	)
+
+	bucketErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gcsproxy_bucket_errors_total",
+			Help: "Total number of failed requests against a bucket, by bucket and method.",
+		},
+		[]string{"bucket", "method"},
+	)
+
+	gcsOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gcsproxy_gcs_operation_duration_seconds",
+			Help:    "Latency of upstream GCS calls, by operation.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+
+	bytesInTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcsproxy_bytes_in_total",
+		Help: "Total number of bytes read from clients and written to GCS.",
+	})
+
+	bytesOutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcsproxy_bytes_out_total",
+		Help: "Total number of bytes read from GCS and written to clients.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestsInFlight,
+		bucketRequestsTotal,
+		bucketErrorsTotal,
+		gcsOperationDuration,
+		bytesInTotal,
+		bytesOutTotal,
+	)
+}
+
+// observeGCSCall times a single upstream GCS call and records it under operation.
+func observeGCSCall(operation string, fn func() error) error {
+	proc := time.Now()
+	err := fn()
+	gcsOperationDuration.WithLabelValues(operation).Observe(time.Now().Sub(proc).Seconds())
+	return err
+}
+
+// observeBucketRequest records a request against bucket, tagging it with the HTTP status it
+// produced and incrementing the error counter when err is non-nil.
+func observeBucketRequest(bucket, method string, status int, err error) {
+	bucketRequestsTotal.WithLabelValues(bucket, method, strconv.Itoa(status)).Inc()
+	if err != nil {
+		bucketErrorsTotal.WithLabelValues(bucket, method).Inc()
+	}
+}